@@ -0,0 +1,242 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "odoh_cache_hits_total",
+		Help: "Responses served from the response cache without a fresh upstream lookup.",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "odoh_cache_misses_total",
+		Help: "Lookups that required a fresh upstream query because nothing usable was cached.",
+	})
+	cacheStaleServes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "odoh_cache_stale_serves_total",
+		Help: "Responses served from an expired cache entry while a refresh happened in the background.",
+	})
+)
+
+// cacheKey identifies a cacheable query. ecsScope captures the client
+// subnet scope an upstream answered for, since a response scoped to a
+// /24 isn't necessarily valid for every client under it; do records the
+// DNSSEC OK bit because DO and non-DO queries for the same name/type
+// can get materially different answers.
+type cacheKey struct {
+	qname    string
+	qtype    uint16
+	qclass   uint16
+	do       bool
+	ecsScope string
+}
+
+// cacheKeyFor builds the cache key for msg, reporting false if msg
+// doesn't have exactly one question and so isn't cacheable.
+func cacheKeyFor(msg *dns.Msg) (cacheKey, bool) {
+	if len(msg.Question) != 1 {
+		return cacheKey{}, false
+	}
+
+	key := cacheKey{
+		qname:  msg.Question[0].Name,
+		qtype:  msg.Question[0].Qtype,
+		qclass: msg.Question[0].Qclass,
+	}
+
+	if opt := msg.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				key.ecsScope = fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+			}
+		}
+	}
+
+	return key, true
+}
+
+// cacheEntry holds a stored response along with enough bookkeeping to
+// decrement TTLs on read and decide when it's gone stale.
+type cacheEntry struct {
+	key        cacheKey
+	msg        *dns.Msg
+	storedAt   time.Time
+	ttl        time.Duration
+	refreshing bool
+}
+
+// responseCache is an in-process LRU cache of upstream DNS responses,
+// keyed by question and the request shape that can change the answer.
+// Entries past their TTL are served for staleGrace while a refresh
+// happens asynchronously (stale-while-revalidate).
+type responseCache struct {
+	mu         sync.Mutex
+	items      map[cacheKey]*list.Element
+	order      *list.List
+	capacity   int
+	maxTTL     time.Duration
+	staleGrace time.Duration
+}
+
+func newResponseCache(capacity int, maxTTL, staleGrace time.Duration) *responseCache {
+	return &responseCache{
+		items:      make(map[cacheKey]*list.Element),
+		order:      list.New(),
+		capacity:   capacity,
+		maxTTL:     maxTTL,
+		staleGrace: staleGrace,
+	}
+}
+
+// get returns a copy of the cached response with RR TTLs decremented by
+// the elapsed time, reporting whether it's being served stale.
+func (c *responseCache) get(key cacheKey) (response *dns.Msg, stale bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.items[key]
+	if !found {
+		return nil, false, false
+	}
+	entry := elem.Value.(*cacheEntry)
+
+	elapsed := time.Since(entry.storedAt)
+	remaining := entry.ttl - elapsed
+	if remaining <= -c.staleGrace {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		return nil, false, false
+	}
+
+	c.order.MoveToFront(elem)
+
+	copied := entry.msg.Copy()
+	ttl := uint32(0)
+	if remaining > 0 {
+		ttl = uint32(remaining.Seconds())
+	}
+	decrementTTLs(copied, ttl, uint32(elapsed.Seconds()))
+
+	return copied, remaining <= 0, true
+}
+
+// markRefreshing reports whether this caller won the right to refresh a
+// stale entry, so concurrent requests for the same key don't all
+// trigger their own upstream lookup.
+func (c *responseCache) markRefreshing(key cacheKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.items[key]
+	if !found {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+// clearRefreshing releases the refresh claim taken by markRefreshing,
+// so a failed background refresh doesn't wedge the entry into never
+// being retried again until it ages out of the stale grace period.
+func (c *responseCache) clearRefreshing(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.items[key]; found {
+		elem.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+// put stores response under key, evicting the least-recently-used entry
+// if the cache is full.
+func (c *responseCache) put(key cacheKey, response *dns.Msg) {
+	ttl := minTTL(response)
+	if ttl <= 0 {
+		return
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, msg: response.Copy(), storedAt: time.Now(), ttl: ttl}
+	if elem, found := c.items[key]; found {
+		c.order.MoveToFront(elem)
+		elem.Value = entry
+		return
+	}
+
+	elem := c.order.PushFront(entry)
+	c.items[key] = elem
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// minTTL computes how long response may be cached: the smallest RR TTL
+// across the answer section for a positive response, or the SOA
+// minimum field for a negative (NXDOMAIN/NODATA) response, per the
+// negative caching rules in RFC 2308.
+func minTTL(response *dns.Msg) time.Duration {
+	if len(response.Answer) > 0 {
+		var min uint32
+		for i, rr := range response.Answer {
+			if i == 0 || rr.Header().Ttl < min {
+				min = rr.Header().Ttl
+			}
+		}
+		return time.Duration(min) * time.Second
+	}
+
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Header().Ttl < ttl {
+				ttl = soa.Header().Ttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+
+	return 0
+}
+
+// decrementTTLs subtracts elapsedSeconds from every RR's TTL (floored
+// at floor, which is 0 once the entry has expired and is being served
+// stale) across all sections of msg.
+func decrementTTLs(msg *dns.Msg, floor, elapsedSeconds uint32) {
+	adjust := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Ttl > elapsedSeconds {
+				hdr.Ttl -= elapsedSeconds
+			} else {
+				hdr.Ttl = floor
+			}
+		}
+	}
+	adjust(msg.Answer)
+	adjust(msg.Ns)
+	adjust(msg.Extra)
+}
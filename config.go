@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/cisco/go-hpke"
+	"github.com/cloudflare/odoh-go"
+)
+
+// odohKeyPair wraps the HPKE keypair used to decrypt ODoH queries and
+// encrypt their responses, along with the wire-format config derived
+// from it. It is safe for concurrent use; set() swaps the keypair
+// under a lock so in-flight requests always see a consistent value.
+type odohKeyPair struct {
+	mu      sync.RWMutex
+	keyPair odoh.ObliviousDoHKeyPair
+	configs odoh.ObliviousDoHConfigs
+}
+
+// current returns the active keypair and its serialized configs.
+func (k *odohKeyPair) current() (odoh.ObliviousDoHKeyPair, odoh.ObliviousDoHConfigs) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keyPair, k.configs
+}
+
+func (k *odohKeyPair) set(pair odoh.ObliviousDoHKeyPair) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keyPair = pair
+	k.configs = odoh.CreateObliviousDoHConfigs([]odoh.ObliviousDoHConfig{pair.Config})
+}
+
+// loadPrivateKeyPEM reads a PEM-encoded HPKE private key (the "seed"
+// passed to odoh.CreateKeyPairFromSeed) and builds the corresponding
+// ObliviousDoHKeyPair for the X25519-HKDF-SHA256/AES-128-GCM suite
+// required by RFC 9230.
+func loadPrivateKeyPEM(path string) (odoh.ObliviousDoHKeyPair, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return odoh.ObliviousDoHKeyPair{}, fmt.Errorf("reading HPKE key file: %w", err)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return odoh.ObliviousDoHKeyPair{}, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	pair, err := odoh.CreateKeyPairFromSeed(hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128, block.Bytes)
+	if err != nil {
+		return odoh.ObliviousDoHKeyPair{}, fmt.Errorf("building HPKE keypair: %w", err)
+	}
+
+	return pair, nil
+}
+
+// newOdohKeyPair loads the keypair at path, or generates a fresh
+// ephemeral one (logging a warning) when path is empty.
+func newOdohKeyPair(path string) (*odohKeyPair, error) {
+	var pair odoh.ObliviousDoHKeyPair
+	var err error
+	if path == "" {
+		log.Println("No -config path given, generating an ephemeral HPKE keypair")
+		pair, err = odoh.CreateDefaultKeyPair()
+	} else {
+		pair, err = loadPrivateKeyPEM(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &odohKeyPair{}
+	k.set(pair)
+	return k, nil
+}
+
+// watchForRotation reloads the keypair from path every time the process
+// receives SIGHUP, so operators can rotate the HPKE key without a
+// restart. It runs until the process exits.
+func (k *odohKeyPair) watchForRotation(path string) {
+	if path == "" {
+		return
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			pair, err := loadPrivateKeyPEM(path)
+			if err != nil {
+				log.Println("SIGHUP key rotation failed, keeping existing key:", err)
+				continue
+			}
+			k.set(pair)
+			log.Println("Rotated HPKE keypair from", path)
+		}
+	}()
+}
+
+// configHandler serves the target's ObliviousDoHConfigs at
+// /.well-known/odohconfigs, as required by RFC 9230 Section 4.
+func (s *odohServer) configHandler(w http.ResponseWriter, r *http.Request) {
+	_, configs := s.keys.current()
+	packed := configs.Marshal()
+
+	w.Header().Set("Content-Type", "application/binary")
+	w.Write(packed)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+)
+
+// decryptObliviousQuery unwraps an ObliviousDoHMessage received on
+// /dns-query, returning the inner DNS query and the response context
+// needed to encrypt the matching reply under the same HPKE exchange.
+func (s *odohServer) decryptObliviousQuery(body []byte) (*dns.Msg, odoh.ResponseContext, error) {
+	keyPair, _ := s.keys.current()
+
+	obliviousMsg, err := odoh.UnmarshalDNSMessage(body)
+	if err != nil {
+		return nil, odoh.ResponseContext{}, fmt.Errorf("unmarshaling oblivious message: %w", err)
+	}
+	if obliviousMsg.MessageType != odoh.QueryType {
+		return nil, odoh.ResponseContext{}, fmt.Errorf("expected an oblivious query, got a response")
+	}
+
+	query, responseContext, err := keyPair.DecryptQuery(obliviousMsg)
+	if err != nil {
+		return nil, odoh.ResponseContext{}, fmt.Errorf("decrypting oblivious query: %w", err)
+	}
+
+	msg := &dns.Msg{}
+	if err := msg.Unpack(query.DnsMessage); err != nil {
+		return nil, odoh.ResponseContext{}, fmt.Errorf("unpacking decrypted query: %w", err)
+	}
+	if len(msg.Question) != 1 {
+		return nil, odoh.ResponseContext{}, fmt.Errorf("expected exactly one question, got %d", len(msg.Question))
+	}
+
+	return msg, responseContext, nil
+}
+
+// encryptObliviousResponse packs the resolved DNS message and encrypts
+// it under the secret derived from the original query, producing the
+// ObliviousDoHMessage bytes to return to the client.
+func encryptObliviousResponse(response *dns.Msg, responseContext odoh.ResponseContext) ([]byte, error) {
+	packed, err := response.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing DNS response: %w", err)
+	}
+
+	obliviousResponse, err := responseContext.EncryptResponse(odoh.CreateObliviousDNSResponse(packed, 0))
+	if err != nil {
+		return nil, fmt.Errorf("encrypting oblivious response: %w", err)
+	}
+
+	return obliviousResponse.Marshal(), nil
+}
@@ -2,152 +2,237 @@ package main
 
 import (
 	"encoding/base64"
-	"io/ioutil"
+	"flag"
 	"fmt"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
 	"log"
-	"time"
-	"net"
 	"net/http"
-	"github.com/miekg/dns"
+	"strings"
+	"time"
 )
 
 type odohServer struct {
-	verbose  bool
-	nameserver string
-	timeout time.Duration
-	connection *dns.Conn
+	verbose        bool
+	timeout        time.Duration
+	resolver       Resolver
+	keys           *odohKeyPair
+	allowCleartext bool
+	cache          *responseCache
 }
 
-func (s *odohServer) startConnection(nameserver string, timeout time.Duration) error {
-	s.connection = new(dns.Conn)
-	var err error
-	if s.connection.Conn, err = net.DialTimeout("tcp", nameserver, timeout * time.Millisecond); err != nil {
-		return fmt.Errorf("Failed starting resolver connection")
+// resolve answers msg from the response cache when possible, otherwise
+// queries the upstream resolver and, if caching is enabled, stores the
+// result keyed by the question and request shape.
+func (s *odohServer) resolve(msg *dns.Msg) (*dns.Msg, error) {
+	if s.cache != nil {
+		if key, ok := cacheKeyFor(msg); ok {
+			if response, stale, ok := s.cache.get(key); ok {
+				cacheHits.Inc()
+				if stale && s.cache.markRefreshing(key) {
+					cacheStaleServes.Inc()
+					go s.refreshCache(key, msg)
+				}
+				response.Id = msg.Id
+				return response, nil
+			}
+			cacheMisses.Inc()
+		}
 	}
 
-	return nil
+	return s.lookUpUpstream(msg)
 }
 
-func (s *odohServer) resolve(msg *dns.Msg) (*dns.Msg, error) {
-	err := s.startConnection(s.nameserver, s.timeout)
+func (s *odohServer) lookUpUpstream(msg *dns.Msg) (*dns.Msg, error) {
+	response, elapsed, err := s.resolver.LookUp(msg)
 	if err != nil {
 		return nil, err
 	}
-
-	s.connection.SetReadDeadline(time.Now().Add(s.timeout * time.Millisecond))
-	s.connection.SetWriteDeadline(time.Now().Add(s.timeout * time.Millisecond))
-
-	if err := s.connection.WriteMsg(msg); err != nil {
-		return nil, err
+	if s.verbose {
+		log.Printf("Upstream lookup for qid=%d took %s", msg.Id, elapsed)
 	}
 
-	response, err := s.connection.ReadMsg()
-	if err != nil {
-		return nil, err
+	if s.cache != nil {
+		if key, ok := cacheKeyFor(msg); ok {
+			s.cache.put(key, response)
+		}
 	}
 
 	return response, nil
 }
 
-func (s *odohServer) parseRequestFromGET(r *http.Request) (string, string, uint16, error) {
+// refreshCache re-queries the upstream for a stale cache entry in the
+// background, so the client that triggered the stale-while-revalidate
+// serve doesn't pay the latency itself. On failure it releases the
+// refresh claim so the next request for key can try again, rather than
+// leaving the entry wedged as stale-but-unrefreshable until it expires.
+func (s *odohServer) refreshCache(key cacheKey, msg *dns.Msg) {
+	if _, err := s.lookUpUpstream(msg); err != nil {
+		log.Println("Background cache refresh failed:", err)
+		s.cache.clearRefreshing(key)
+	}
+}
+
+// parseRequestFromGET decodes the base64url "dns" query parameter used
+// by the DoH GET form (RFC 8484 Section 4.1) into the client's original
+// *dns.Msg, unmodified.
+func (s *odohServer) parseRequestFromGET(r *http.Request) (*dns.Msg, error) {
 	encoded := r.URL.Query().Get("dns")
 	if encoded == "" {
-		return "", "", uint16(0), fmt.Errorf("Missing DNS query parameter in GET request")
+		return nil, fmt.Errorf("Missing DNS query parameter in GET request")
 	}
 
 	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
 	if err != nil {
-		return "", "", uint16(0), err
+		return nil, err
 	}
 
 	msg := &dns.Msg{}
 	if err := msg.Unpack(decoded); err != nil {
-		return "", "", uint16(0), err
+		return nil, err
 	}
 	if len(msg.Question) != 1 {
-		return "", "", uint16(0), err
+		return nil, fmt.Errorf("expected exactly one question, got %d", len(msg.Question))
 	}
-	
-	return msg.Question[0].Name, dns.Type(msg.Question[0].Qtype).String(), msg.Id, nil
+
+	return msg, nil
 }
 
-func (s *odohServer) parseRequestFromPOST(r *http.Request) (string, string, uint16, error) {
+// parseRequestFromPOST unpacks the application/dns-message body used by
+// the DoH POST form (RFC 8484 Section 4.1) into the client's original
+// *dns.Msg, unmodified.
+func (s *odohServer) parseRequestFromPOST(r *http.Request) (*dns.Msg, error) {
 	if r.Header.Get("Content-Type") != "application/dns-message" {
-		return "", "", uint16(0), fmt.Errorf("incorrect content type, expected 'application/dns-message', got %s", r.Header.Get("Content-Type"))
+		return nil, fmt.Errorf("incorrect content type, expected 'application/dns-message', got %s", r.Header.Get("Content-Type"))
 	}
 	defer r.Body.Close()
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return "", "", uint16(0), err
+		return nil, err
 	}
 
-	// Parse the DNS message
 	msg := &dns.Msg{}
 	if err := msg.Unpack(body); err != nil {
-		return "", "", uint16(0), err
+		return nil, err
 	}
 	if len(msg.Question) != 1 {
-		return "", "", uint16(0), err
+		return nil, fmt.Errorf("expected exactly one question, got %d", len(msg.Question))
 	}
 
 	if s.verbose {
 		log.Printf("%s Unpacked DNS message:\n %s\n", r.Method, msg)
 	}
 
-	return msg.Question[0].Name, dns.Type(msg.Question[0].Qtype).String(), msg.Id, nil
+	return msg, nil
 }
 
-func (s *odohServer) parseRequest(r *http.Request) (string, string, uint16, error) {
+func (s *odohServer) parseRequest(r *http.Request) (*dns.Msg, error) {
 	switch r.Method {
 	case "GET":
 		return s.parseRequestFromGET(r)
 	case "POST":
 		return s.parseRequestFromPOST(r)
 	default:
-		return "", "", uint16(0), fmt.Errorf("unsupported HTTP method")
+		return nil, fmt.Errorf("unsupported HTTP method")
 	}
 }
 
-func createQuery(n, t string) *dns.Msg {
-	queryMessage := &dns.Msg {
-		MsgHdr: dns.MsgHdr {
-			Opcode: dns.OpcodeQuery,
-		},
-		Question: make([]dns.Question, 1),
+// paddingBlockSize is the block size RFC 8467 recommends for EDNS0
+// padding on DoH queries and responses.
+const paddingBlockSize = 128
+
+// normalizePadding rewrites an existing EDNS0 padding option on msg so
+// its length brings the packed message up to the next multiple of
+// paddingBlockSize, per RFC 8467. Messages without an OPT RR, or
+// without a padding option, are left untouched.
+func normalizePadding(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
 	}
 
-	qtype := dns.TypeAAAA
-	if t == "A" {
-		qtype = dns.TypeA
+	for _, o := range opt.Option {
+		if padding, ok := o.(*dns.EDNS0_PADDING); ok {
+			padding.Padding = nil
+			packed, err := msg.Pack()
+			if err != nil {
+				return
+			}
+			unpadded := len(packed)
+			padded := ((unpadded / paddingBlockSize) + 1) * paddingBlockSize
+			padding.Padding = make([]byte, padded-unpadded)
+			return
+		}
+	}
+}
+
+// obliviousQueryHandler serves the ODoH target path: it decrypts the
+// ObliviousDoHMessage body, resolves the inner query against the
+// upstream nameserver, and returns the encrypted response per RFC 9230.
+func (s *odohServer) obliviousQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Failed reading oblivious request body:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
 
-	queryMessage.Question[0] = dns.Question{
-		Name: dns.Fqdn(n), 
-		Qtype: qtype,
-		Qclass: uint16(dns.ClassINET),
+	query, responseContext, err := s.decryptObliviousQuery(body)
+	if err != nil {
+		log.Println("Failed decrypting oblivious query:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
-	queryMessage.Id = dns.Id()
-	queryMessage.Rcode = dns.RcodeSuccess
-	queryMessage.RecursionDesired = true
 
-	return queryMessage
+	response, err := s.resolve(query)
+	if err != nil {
+		log.Println("Query failed:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	packed, err := encryptObliviousResponse(response, responseContext)
+	if err != nil {
+		log.Println("Failed encrypting oblivious response:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/oblivious-dns-message")
+	w.Write(packed)
 }
 
 func (s *odohServer) queryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") == "application/oblivious-dns-message" {
+		s.obliviousQueryHandler(w, r)
+		return
+	}
+
+	if !s.allowCleartext {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
 	log.Println("Handling /odoh request")
 
-	n, t, id, err := s.parseRequest(r)
+	query, err := s.parseRequest(r)
 	if err != nil {
 		log.Println("Failed parsing request:", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-			
+	normalizePadding(query)
+
 	if s.verbose {
-		log.Printf("%s Resolving: %s %s %d", r.Method, n, t, id)
+		log.Printf("%s Resolving: %s %s %d", r.Method, query.Question[0].Name, dns.Type(query.Question[0].Qtype).String(), query.Id)
 	}
 
-	query := createQuery(n, t)
 	start := time.Now()
 	response, err := s.resolve(query)
 	elapsed := time.Now().Sub(start)
@@ -156,6 +241,7 @@ func (s *odohServer) queryHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	response.Id = query.Id
 
 	packed, err := response.Pack()
 	if err != nil {
@@ -165,8 +251,8 @@ func (s *odohServer) queryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if s.verbose {
-		log.Printf("%s Query: qname='%s' qtype='%s' qid=%d elapsed=%s\n", r.Method, n, t, id, elapsed.String())
-		log.Printf("%s Answer: ", r.Method, response.Answer)
+		log.Printf("%s Query: qname='%s' qtype='%s' qid=%d elapsed=%s\n", r.Method, query.Question[0].Name, dns.Type(query.Question[0].Qtype).String(), query.Id, elapsed.String())
+		log.Printf("%s Answer: %v", r.Method, response.Answer)
 		log.Printf("%s Full response: %s\n", r.Method, string(packed))
 		log.Printf("%s Raw response: %x\n", r.Method, packed)
 	}
@@ -190,17 +276,79 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to a PEM-encoded HPKE private key seed; an ephemeral key is generated when unset")
+	allowCleartext := flag.Bool("cleartext", true, "also serve plain application/dns-message DoH on /dns-query; disable for pure-ODoH mode")
+	upstream := flag.String("upstream", "1.1.1.1:53", "comma-separated upstream resolver addresses, tried in order; supports udp://, tcp://, tls://, and https:// schemes")
+	poolSize := flag.Int("pool-size", defaultPoolConfig.size, "max concurrent persistent connections per TCP/TLS upstream")
+	poolMaxIdle := flag.Duration("pool-max-idle", defaultPoolConfig.maxIdle, "how long an idle pooled upstream connection may sit before it's retired")
+	poolMaxLifetime := flag.Duration("pool-max-lifetime", defaultPoolConfig.maxLife, "max age of a pooled upstream connection before it's retired")
+	listenAddr := flag.String("listen", ":8443", "address to serve the TLS-terminated /dns-query and /.well-known/odohconfigs endpoints on")
+	healthAddr := flag.String("health-listen", ":8080", "address to serve the plaintext /health endpoint on, separate from the query listener")
+	certFile := flag.String("cert", "", "TLS certificate file for the query listener")
+	keyFile := flag.String("key", "", "TLS private key file for the query listener")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version to accept on the query listener (\"1.2\" or \"1.3\")")
+	acmeCacheDir := flag.String("acme-cache-dir", "", "directory to cache ACME certificates in; enables autocert when -cert/-key are unset")
+	acmeHost := flag.String("acme-host", "", "comma-separated hostnames autocert is allowed to request certificates for")
+	cacheSize := flag.Int("cache-size", 0, "max entries in the response cache; 0 disables caching")
+	cacheServeStale := flag.Duration("cache-serve-stale", 30*time.Second, "how long to keep serving an expired cache entry while it's refreshed in the background")
+	cacheMaxTTL := flag.Duration("cache-max-ttl", 0, "cap how long any response is cached, regardless of its own TTL; 0 means no cap")
+	flag.Parse()
+
+	keys, err := newOdohKeyPair(*configPath)
+	if err != nil {
+		log.Fatal("Failed to load HPKE keypair:", err)
+	}
+	keys.watchForRotation(*configPath)
+
 	timeout := 2500 * time.Millisecond
-	server := odohServer {
-		verbose: true,
-		timeout: timeout,
-		nameserver: "1.1.1.1:53",
+	pool := poolConfig{size: *poolSize, maxIdle: *poolMaxIdle, maxLife: *poolMaxLifetime}
+	resolver, err := AddressesToUpstream(strings.Split(*upstream, ","), timeout, pool)
+	if err != nil {
+		log.Fatal("Failed to configure upstream resolver:", err)
+	}
+
+	server := odohServer{
+		verbose:        true,
+		timeout:        timeout,
+		resolver:       resolver,
+		keys:           keys,
+		allowCleartext: *allowCleartext,
+	}
+	if *cacheSize > 0 {
+		server.cache = newResponseCache(*cacheSize, *cacheMaxTTL, *cacheServeStale)
+	}
+
+	queryMux := http.NewServeMux()
+	queryMux.HandleFunc("/dns-query", server.queryHandler)
+	queryMux.HandleFunc("/.well-known/odohconfigs", server.configHandler)
+	queryMux.HandleFunc("/", handle)
+
+	healthMux := http.NewServeMux()
+	healthMux.HandleFunc("/health", healthCheckHandler)
+	healthMux.Handle("/metrics", promhttp.Handler())
+
+	minVersion, err := tlsMinVersionFromString(*tlsMinVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var acmeHosts []string
+	if *acmeHost != "" {
+		acmeHosts = strings.Split(*acmeHost, ",")
+	}
+
+	queryServer, err := buildQueryServer(*listenAddr, queryMux, tlsOptions{
+		certFile:     *certFile,
+		keyFile:      *keyFile,
+		minVersion:   minVersion,
+		acmeCacheDir: *acmeCacheDir,
+		acmeHosts:    acmeHosts,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	http.HandleFunc("/dns-query", server.queryHandler)
-	http.HandleFunc("/health", healthCheckHandler)
-	http.HandleFunc("/", handle)
+	healthServer := &http.Server{Addr: *healthAddr, Handler: healthMux}
 
-	log.Print("Listening on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	serveUntilShutdown(queryServer, healthServer, *certFile, *keyFile)
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// qtypes lists the question types that must survive parsing unchanged,
+// including ones createQuery used to silently coerce to AAAA.
+var qtypes = []uint16{
+	dns.TypeA,
+	dns.TypeAAAA,
+	dns.TypeTXT,
+	dns.TypeMX,
+	dns.TypeCAA,
+	dns.TypeSVCB,
+	dns.TypeHTTPS,
+	dns.TypeDS,
+	dns.TypeDNSKEY,
+}
+
+func newQuestionMsg(qtype uint16) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", qtype)
+	msg.Id = 0x1234
+	return msg
+}
+
+func TestParseRequestFromPOSTRoundTripsQtype(t *testing.T) {
+	s := &odohServer{}
+
+	for _, qtype := range qtypes {
+		want := newQuestionMsg(qtype)
+		packed, err := want.Pack()
+		if err != nil {
+			t.Fatalf("packing %s query: %v", dns.Type(qtype), err)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+		r.Header.Set("Content-Type", "application/dns-message")
+
+		got, err := s.parseRequestFromPOST(r)
+		if err != nil {
+			t.Fatalf("parseRequestFromPOST(%s): %v", dns.Type(qtype), err)
+		}
+
+		if got.Question[0].Qtype != qtype {
+			t.Errorf("qtype = %s, want %s", dns.Type(got.Question[0].Qtype), dns.Type(qtype))
+		}
+		if got.Id != want.Id {
+			t.Errorf("id = %d, want %d", got.Id, want.Id)
+		}
+	}
+}
+
+func TestParseRequestFromGETRoundTripsQtype(t *testing.T) {
+	s := &odohServer{}
+
+	for _, qtype := range qtypes {
+		want := newQuestionMsg(qtype)
+		packed, err := want.Pack()
+		if err != nil {
+			t.Fatalf("packing %s query: %v", dns.Type(qtype), err)
+		}
+		encoded := base64.RawURLEncoding.EncodeToString(packed)
+
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+encoded, nil)
+
+		got, err := s.parseRequestFromGET(r)
+		if err != nil {
+			t.Fatalf("parseRequestFromGET(%s): %v", dns.Type(qtype), err)
+		}
+
+		if got.Question[0].Qtype != qtype {
+			t.Errorf("qtype = %s, want %s", dns.Type(got.Question[0].Qtype), dns.Type(qtype))
+		}
+		if got.Id != want.Id {
+			t.Errorf("id = %d, want %d", got.Id, want.Id)
+		}
+	}
+}
+
+func TestNormalizePaddingRoundsToBlockSize(t *testing.T) {
+	msg := newQuestionMsg(dns.TypeA)
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: []byte{0}})
+	msg.Extra = append(msg.Extra, opt)
+
+	normalizePadding(msg)
+
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("packing padded message: %v", err)
+	}
+	if len(packed)%paddingBlockSize != 0 {
+		t.Errorf("packed length %d is not a multiple of %d", len(packed), paddingBlockSize)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// poolConfig tunes a stream pool's size and connection lifetimes.
+type poolConfig struct {
+	size    int
+	maxIdle time.Duration
+	maxLife time.Duration
+}
+
+// defaultPoolConfig is used when the operator doesn't override the
+// -pool-* flags.
+var defaultPoolConfig = poolConfig{size: 8, maxIdle: 30 * time.Second, maxLife: 5 * time.Minute}
+
+// pooledConn is one persistent, pipelined connection to an upstream: a
+// single dns.Conn shared by concurrent lookups, each demultiplexed by
+// its DNS message ID so callers never block on each other.
+type pooledConn struct {
+	conn   *dns.Conn
+	opened time.Time
+
+	mu      sync.Mutex
+	waiters map[uint16]chan *dns.Msg
+	lastUse time.Time
+	dead    bool
+}
+
+func newPooledConn(network, address string, tlsConfig *tls.Config, timeout time.Duration) (*pooledConn, error) {
+	var inner net.Conn
+	var err error
+	if tlsConfig != nil {
+		inner, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, tlsConfig)
+	} else {
+		inner, err = net.DialTimeout(network, address, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dialing pooled upstream connection: %w", err)
+	}
+
+	now := time.Now()
+	pc := &pooledConn{
+		conn:    &dns.Conn{Conn: inner},
+		opened:  now,
+		lastUse: now,
+		waiters: make(map[uint16]chan *dns.Msg),
+	}
+	go pc.readLoop()
+	return pc, nil
+}
+
+// readLoop demultiplexes pipelined responses by message ID, handing
+// each to the waiter that's expecting it.
+func (pc *pooledConn) readLoop() {
+	for {
+		msg, err := pc.conn.ReadMsg()
+		pc.mu.Lock()
+		if err != nil {
+			pc.dead = true
+			for id, ch := range pc.waiters {
+				close(ch)
+				delete(pc.waiters, id)
+			}
+			pc.mu.Unlock()
+			pc.conn.Close()
+			return
+		}
+
+		ch, ok := pc.waiters[msg.Id]
+		if ok {
+			delete(pc.waiters, msg.Id)
+		}
+		pc.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+// healthy reports whether this connection is still usable: its
+// readLoop hasn't seen an error, and it's younger than maxLife.
+func (pc *pooledConn) healthy(maxLife time.Duration) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return !pc.dead && time.Since(pc.opened) < maxLife
+}
+
+func (pc *pooledConn) idleFor() time.Duration {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return time.Since(pc.lastUse)
+}
+
+func (pc *pooledConn) lookUp(msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+	pc.mu.Lock()
+	if pc.dead {
+		pc.mu.Unlock()
+		return nil, fmt.Errorf("pooled connection is closed")
+	}
+	pc.waiters[msg.Id] = ch
+	pc.lastUse = time.Now()
+	pc.mu.Unlock()
+
+	pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := pc.conn.WriteMsg(msg); err != nil {
+		pc.mu.Lock()
+		delete(pc.waiters, msg.Id)
+		pc.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("pooled connection closed while awaiting response")
+		}
+		return response, nil
+	case <-time.After(timeout):
+		pc.mu.Lock()
+		delete(pc.waiters, msg.Id)
+		pc.mu.Unlock()
+		return nil, fmt.Errorf("timed out waiting for upstream response")
+	}
+}
+
+// streamPool is a bounded, pipelined pool of persistent TCP or
+// TCP-TLS connections to a single upstream, replacing the old
+// dial-a-socket-per-query behavior. Connections idle past
+// config.maxIdle or older than config.maxLife are retired lazily on
+// checkout rather than via a background sweep.
+type streamPool struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	config    poolConfig
+
+	mu   sync.Mutex
+	idle []*pooledConn
+	sem  chan struct{}
+}
+
+func newStreamPool(network, address string, tlsConfig *tls.Config, timeout time.Duration, config poolConfig) *streamPool {
+	if config.size <= 0 {
+		config.size = defaultPoolConfig.size
+	}
+	return &streamPool{
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+		config:    config,
+		sem:       make(chan struct{}, config.size),
+	}
+}
+
+func (p *streamPool) checkout() (*pooledConn, error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if pc.healthy(p.config.maxLife) && pc.idleFor() < p.config.maxIdle {
+			p.mu.Unlock()
+			return pc, nil
+		}
+		pc.conn.Close()
+	}
+	p.mu.Unlock()
+
+	return newPooledConn(p.network, p.address, p.tlsConfig, p.timeout)
+}
+
+func (p *streamPool) checkin(pc *pooledConn) {
+	if !pc.healthy(p.config.maxLife) {
+		pc.conn.Close()
+		return
+	}
+	p.mu.Lock()
+	p.idle = append(p.idle, pc)
+	p.mu.Unlock()
+}
+
+// LookUp implements Resolver, bounding in-flight concurrency to the
+// pool's size and reusing a pipelined connection for every lookup.
+func (p *streamPool) LookUp(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+
+	pc, err := p.checkout()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	response, err := pc.lookUp(msg, p.timeout)
+	elapsed := time.Since(start)
+	if err != nil {
+		return nil, elapsed, err
+	}
+
+	p.checkin(pc)
+	return response, elapsed, nil
+}
+
+// udpPool is a single long-lived UDP socket to an upstream, with
+// responses demultiplexed back to their caller by DNS message ID,
+// since UDP has no connection state to pipeline over. Callers commonly
+// share the same message ID (RFC 8484 recommends DoH clients always
+// send 0), so every outbound query is rewritten to an ID that's unique
+// among those currently in flight on this socket; the caller's
+// original ID is restored on the reply.
+type udpPool struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+
+	mu      sync.Mutex
+	waiters map[uint16]*udpWaiter
+}
+
+type udpWaiter struct {
+	originalID uint16
+	ch         chan *dns.Msg
+}
+
+func newUDPPool(address string, timeout time.Duration) (*udpPool, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("resolving UDP upstream address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing UDP upstream: %w", err)
+	}
+
+	p := &udpPool{conn: conn, timeout: timeout, waiters: make(map[uint16]*udpWaiter)}
+	go p.readLoop()
+	return p, nil
+}
+
+func (p *udpPool) readLoop() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		msg := &dns.Msg{}
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		p.mu.Lock()
+		waiter, ok := p.waiters[msg.Id]
+		if ok {
+			delete(p.waiters, msg.Id)
+		}
+		p.mu.Unlock()
+		if ok {
+			msg.Id = waiter.originalID
+			waiter.ch <- msg
+		}
+	}
+}
+
+// reserveID picks a wire ID not already in flight on this socket. The
+// caller must hold p.mu.
+func (p *udpPool) reserveID() uint16 {
+	for {
+		id := dns.Id()
+		if _, inUse := p.waiters[id]; !inUse {
+			return id
+		}
+	}
+}
+
+func (p *udpPool) LookUp(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	originalID := msg.Id
+
+	p.mu.Lock()
+	wireID := p.reserveID()
+	ch := make(chan *dns.Msg, 1)
+	p.waiters[wireID] = &udpWaiter{originalID: originalID, ch: ch}
+	p.mu.Unlock()
+
+	outbound := msg.Copy()
+	outbound.Id = wireID
+	packed, err := outbound.Pack()
+	if err != nil {
+		p.mu.Lock()
+		delete(p.waiters, wireID)
+		p.mu.Unlock()
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	if _, err := p.conn.Write(packed); err != nil {
+		p.mu.Lock()
+		delete(p.waiters, wireID)
+		p.mu.Unlock()
+		return nil, 0, err
+	}
+
+	select {
+	case response := <-ch:
+		return response, time.Since(start), nil
+	case <-time.After(p.timeout):
+		p.mu.Lock()
+		delete(p.waiters, wireID)
+		p.mu.Unlock()
+		return nil, time.Since(start), fmt.Errorf("timed out waiting for UDP upstream response")
+	}
+}
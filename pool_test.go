@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// echoUDPUpstream is a minimal fake upstream: it unpacks each query,
+// answers with a TXT record derived from the question name, and
+// replies using the query's own wire ID so the test can exercise a
+// pool's ID-collision handling the same way a real resolver would.
+func echoUDPUpstream(t *testing.T) (addr string, stop func()) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listening for fake upstream: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			query := &dns.Msg{}
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+
+			response := new(dns.Msg)
+			response.SetReply(query)
+			response.Answer = append(response.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{query.Question[0].Name},
+			})
+
+			packed, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(packed, from)
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() {
+		conn.Close()
+		<-done
+	}
+}
+
+// TestUDPPoolDemuxesConcurrentQueriesWithSameID verifies that queries
+// sharing the same message ID (as RFC 8484 recommends DoH clients
+// always use, ID 0) are still correctly paired with their own
+// response rather than colliding on the shared socket.
+func TestUDPPoolDemuxesConcurrentQueriesWithSameID(t *testing.T) {
+	addr, stop := echoUDPUpstream(t)
+	defer stop()
+
+	pool, err := newUDPPool(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("newUDPPool: %v", err)
+	}
+
+	const concurrency = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := dns.Fqdn(string(rune('a'+i%26)) + string(rune('A'+i/26)) + ".example.com")
+			query := new(dns.Msg)
+			query.SetQuestion(name, dns.TypeTXT)
+			query.Id = 0
+
+			response, _, err := pool.LookUp(query)
+			if err != nil {
+				errs <- fmt.Errorf("LookUp(%s): %w", name, err)
+				return
+			}
+			if response.Id != 0 {
+				errs <- fmt.Errorf("LookUp(%s): response.Id = %d, want 0", name, response.Id)
+				return
+			}
+			if len(response.Answer) != 1 {
+				errs <- fmt.Errorf("LookUp(%s): got %d answers, want 1", name, len(response.Answer))
+				return
+			}
+			txt, ok := response.Answer[0].(*dns.TXT)
+			if !ok || len(txt.Txt) != 1 || txt.Txt[0] != name {
+				errs <- fmt.Errorf("LookUp(%s): got answer %v, want TXT %q", name, response.Answer[0], name)
+				return
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("query failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver looks up a DNS message against a single upstream, returning
+// the response and how long the round trip took.
+type Resolver interface {
+	LookUp(msg *dns.Msg) (*dns.Msg, time.Duration, error)
+}
+
+func newUDPResolver(address string, timeout time.Duration) Resolver {
+	pool, err := newUDPPool(address, timeout)
+	if err != nil {
+		return erroringResolver{err}
+	}
+	return pool
+}
+
+func newTCPResolver(address string, timeout time.Duration, config poolConfig) Resolver {
+	return newStreamPool("tcp", address, nil, timeout, config)
+}
+
+// erroringResolver reports a fixed setup error from every lookup, so a
+// failure building the long-lived UDP socket surfaces per-query instead
+// of aborting startup.
+type erroringResolver struct {
+	err error
+}
+
+func (r erroringResolver) LookUp(*dns.Msg) (*dns.Msg, time.Duration, error) {
+	return nil, 0, r.err
+}
+
+// newTLSResolver builds a DNS-over-TLS upstream. serverName is used for
+// SNI and certificate verification; if spkiPin (a base64-encoded
+// SHA-256 SPKI hash, as produced by `openssl x509 -pubkey | openssl pkey
+// -pubin -outform der | openssl dgst -sha256 -binary | base64`) is
+// non-empty, the server's leaf certificate must match it regardless of
+// chain validity.
+func newTLSResolver(address, serverName, spkiPin string, timeout time.Duration, config poolConfig) (Resolver, error) {
+	tlsConfig := &tls.Config{ServerName: serverName}
+
+	if spkiPin != "" {
+		wantPin, err := base64.StdEncoding.DecodeString(spkiPin)
+		if err != nil {
+			return nil, fmt.Errorf("decoding SPKI pin: %w", err)
+		}
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(certificates [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range certificates {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					continue
+				}
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if bytes.Equal(digest[:], wantPin) {
+					return nil
+				}
+			}
+			return fmt.Errorf("no peer certificate matched the pinned SPKI hash")
+		}
+	}
+
+	return newStreamPool("tcp-tls", address, tlsConfig, timeout, config), nil
+}
+
+// dohResolver forwards queries to an upstream DNS-over-HTTPS server via
+// POST application/dns-message, per RFC 8484.
+type dohResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newDoHResolver(endpoint string, timeout time.Duration) Resolver {
+	return &dohResolver{endpoint: endpoint, client: &http.Client{Timeout: timeout}}
+}
+
+func (r *dohResolver) LookUp(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("packing query for DoH upstream: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", r.endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	start := time.Now()
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	elapsed := time.Since(start)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, elapsed, fmt.Errorf("DoH upstream returned status %d", resp.StatusCode)
+	}
+
+	response := &dns.Msg{}
+	if err := response.Unpack(body); err != nil {
+		return nil, elapsed, fmt.Errorf("unpacking DoH upstream response: %w", err)
+	}
+
+	return response, elapsed, nil
+}
+
+// fallbackResolver tries each Resolver in order, returning the first
+// successful response.
+type fallbackResolver struct {
+	resolvers []Resolver
+}
+
+func (r *fallbackResolver) LookUp(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var lastErr error
+	for _, resolver := range r.resolvers {
+		response, elapsed, err := resolver.LookUp(msg)
+		if err == nil {
+			return response, elapsed, nil
+		}
+		lastErr = err
+	}
+	return nil, 0, fmt.Errorf("all upstreams failed, last error: %w", lastErr)
+}
+
+// AddressToUpstream parses a single upstream address into a Resolver.
+// Recognized forms, mirroring dnsproxy: "udp://host:53", "tcp://host:53",
+// "tls://host:853" (optionally with "?serverName=" and/or "?spki="
+// query parameters), and "https://host/dns-query". A bare "host:port"
+// is treated as plain TCP, matching this server's historical default.
+func AddressToUpstream(address string, timeout time.Duration, config poolConfig) (Resolver, error) {
+	switch {
+	case strings.HasPrefix(address, "udp://"):
+		return newUDPResolver(strings.TrimPrefix(address, "udp://"), timeout), nil
+
+	case strings.HasPrefix(address, "tcp://"):
+		return newTCPResolver(strings.TrimPrefix(address, "tcp://"), timeout, config), nil
+
+	case strings.HasPrefix(address, "tls://"):
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("parsing DoT upstream %q: %w", address, err)
+		}
+		serverName := parsed.Query().Get("serverName")
+		if serverName == "" {
+			serverName = parsed.Hostname()
+		}
+		return newTLSResolver(parsed.Host, serverName, parsed.Query().Get("spki"), timeout, config)
+
+	case strings.HasPrefix(address, "https://"):
+		return newDoHResolver(address, timeout), nil
+
+	default:
+		return newTCPResolver(address, timeout, config), nil
+	}
+}
+
+// AddressesToUpstream parses a primary address plus any fallback
+// addresses (as supplied via the -upstream flag) into a single Resolver
+// that tries them in order.
+func AddressesToUpstream(addresses []string, timeout time.Duration, config poolConfig) (Resolver, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no upstream addresses given")
+	}
+
+	resolvers := make([]Resolver, 0, len(addresses))
+	for _, address := range addresses {
+		resolver, err := AddressToUpstream(address, timeout, config)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+
+	if len(resolvers) == 1 {
+		return resolvers[0], nil
+	}
+	return &fallbackResolver{resolvers: resolvers}, nil
+}
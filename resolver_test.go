@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddressToUpstreamSchemeDispatch(t *testing.T) {
+	config := defaultPoolConfig
+
+	t.Run("udp", func(t *testing.T) {
+		resolver, err := AddressToUpstream("udp://127.0.0.1:53", time.Second, config)
+		if err != nil {
+			t.Fatalf("AddressToUpstream: %v", err)
+		}
+		if _, ok := resolver.(*udpPool); !ok {
+			t.Fatalf("got %T, want *udpPool", resolver)
+		}
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		resolver, err := AddressToUpstream("tcp://127.0.0.1:53", time.Second, config)
+		if err != nil {
+			t.Fatalf("AddressToUpstream: %v", err)
+		}
+		pool, ok := resolver.(*streamPool)
+		if !ok {
+			t.Fatalf("got %T, want *streamPool", resolver)
+		}
+		if pool.network != "tcp" {
+			t.Errorf("network = %q, want %q", pool.network, "tcp")
+		}
+		if pool.tlsConfig != nil {
+			t.Errorf("tlsConfig = %v, want nil for plain tcp", pool.tlsConfig)
+		}
+	})
+
+	t.Run("bare host:port defaults to tcp", func(t *testing.T) {
+		resolver, err := AddressToUpstream("127.0.0.1:53", time.Second, config)
+		if err != nil {
+			t.Fatalf("AddressToUpstream: %v", err)
+		}
+		pool, ok := resolver.(*streamPool)
+		if !ok {
+			t.Fatalf("got %T, want *streamPool", resolver)
+		}
+		if pool.network != "tcp" {
+			t.Errorf("network = %q, want %q", pool.network, "tcp")
+		}
+	})
+
+	t.Run("tls with serverName and spki", func(t *testing.T) {
+		resolver, err := AddressToUpstream("tls://dns.example.com:853?serverName=override.example.com&spki=AAAA", time.Second, config)
+		if err != nil {
+			t.Fatalf("AddressToUpstream: %v", err)
+		}
+		pool, ok := resolver.(*streamPool)
+		if !ok {
+			t.Fatalf("got %T, want *streamPool", resolver)
+		}
+		if pool.network != "tcp-tls" {
+			t.Errorf("network = %q, want %q", pool.network, "tcp-tls")
+		}
+		if pool.address != "dns.example.com:853" {
+			t.Errorf("address = %q, want %q", pool.address, "dns.example.com:853")
+		}
+		if pool.tlsConfig == nil || pool.tlsConfig.ServerName != "override.example.com" {
+			t.Errorf("tlsConfig.ServerName = %v, want %q", pool.tlsConfig, "override.example.com")
+		}
+		if pool.tlsConfig.VerifyPeerCertificate == nil {
+			t.Errorf("expected VerifyPeerCertificate to be set when spki is given")
+		}
+	})
+
+	t.Run("tls defaults serverName to hostname", func(t *testing.T) {
+		resolver, err := AddressToUpstream("tls://dns.example.com:853", time.Second, config)
+		if err != nil {
+			t.Fatalf("AddressToUpstream: %v", err)
+		}
+		pool := resolver.(*streamPool)
+		if pool.tlsConfig.ServerName != "dns.example.com" {
+			t.Errorf("ServerName = %q, want %q", pool.tlsConfig.ServerName, "dns.example.com")
+		}
+	})
+
+	t.Run("https", func(t *testing.T) {
+		resolver, err := AddressToUpstream("https://dns.example.com/dns-query", time.Second, config)
+		if err != nil {
+			t.Fatalf("AddressToUpstream: %v", err)
+		}
+		doh, ok := resolver.(*dohResolver)
+		if !ok {
+			t.Fatalf("got %T, want *dohResolver", resolver)
+		}
+		if doh.endpoint != "https://dns.example.com/dns-query" {
+			t.Errorf("endpoint = %q, want %q", doh.endpoint, "https://dns.example.com/dns-query")
+		}
+	})
+}
+
+func TestAddressesToUpstreamSingleVsFallback(t *testing.T) {
+	config := defaultPoolConfig
+
+	single, err := AddressesToUpstream([]string{"tcp://127.0.0.1:53"}, time.Second, config)
+	if err != nil {
+		t.Fatalf("AddressesToUpstream: %v", err)
+	}
+	if _, ok := single.(*fallbackResolver); ok {
+		t.Errorf("a single address should not be wrapped in a fallbackResolver")
+	}
+
+	multi, err := AddressesToUpstream([]string{"tcp://127.0.0.1:53", "udp://127.0.0.1:53"}, time.Second, config)
+	if err != nil {
+		t.Fatalf("AddressesToUpstream: %v", err)
+	}
+	fallback, ok := multi.(*fallbackResolver)
+	if !ok {
+		t.Fatalf("got %T, want *fallbackResolver", multi)
+	}
+	if len(fallback.resolvers) != 2 {
+		t.Errorf("got %d resolvers, want 2", len(fallback.resolvers))
+	}
+
+	if _, err := AddressesToUpstream(nil, time.Second, config); err == nil {
+		t.Errorf("expected an error for no addresses")
+	}
+}
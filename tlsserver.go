@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsOptions configures how the query listener terminates TLS: either
+// a static certificate/key pair, or ACME via autocert when acmeCacheDir
+// is set and cert/key are not.
+type tlsOptions struct {
+	certFile     string
+	keyFile      string
+	minVersion   uint16
+	acmeCacheDir string
+	acmeHosts    []string
+}
+
+// tlsMinVersionFromString maps the -tls-min-version flag ("1.2"/"1.3")
+// to the crypto/tls constant, defaulting to TLS 1.2.
+func tlsMinVersionFromString(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported -tls-min-version %q, want \"1.2\" or \"1.3\"", version)
+	}
+}
+
+// buildQueryServer constructs the TLS-terminating *http.Server for the
+// /dns-query and /.well-known/odohconfigs endpoints, with HTTP/2
+// negotiated via ALPN.
+func buildQueryServer(addr string, handler http.Handler, opts tlsOptions) (*http.Server, error) {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion: opts.minVersion,
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+	}
+
+	if opts.certFile != "" && opts.keyFile != "" {
+		return server, nil
+	}
+
+	if opts.acmeCacheDir != "" {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(opts.acmeCacheDir),
+			HostPolicy: autocert.HostWhitelist(opts.acmeHosts...),
+		}
+		server.TLSConfig.GetCertificate = manager.GetCertificate
+		return server, nil
+	}
+
+	return nil, fmt.Errorf("either -cert/-key or -acme-cache-dir (with -acme-host) must be set to serve TLS")
+}
+
+// serveQueryServer starts server, choosing the static certificate path
+// when certFile/keyFile are set and the autocert path otherwise.
+func serveQueryServer(server *http.Server, certFile, keyFile string) error {
+	log.Printf("Listening for ODoH/DoH queries on %s", server.Addr)
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// serveUntilShutdown runs server (and, if non-nil, healthServer)
+// until SIGTERM, then gives in-flight requests up to 10 seconds to
+// finish before returning.
+func serveUntilShutdown(server, healthServer *http.Server, certFile, keyFile string) {
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- serveQueryServer(server, certFile, keyFile)
+	}()
+	if healthServer != nil {
+		go func() {
+			log.Printf("Listening for health checks on %s", healthServer.Addr)
+			errs <- healthServer.ListenAndServe()
+		}()
+	}
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errs:
+		log.Fatal("Server exited unexpectedly:", err)
+	case <-sigterm:
+		log.Println("Received shutdown signal, draining in-flight requests")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down query server:", err)
+	}
+	if healthServer != nil {
+		if err := healthServer.Shutdown(ctx); err != nil {
+			log.Println("Error shutting down health server:", err)
+		}
+	}
+}